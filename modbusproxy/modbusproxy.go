@@ -0,0 +1,363 @@
+// Package modbusproxy serves the holding registers, input registers, coils,
+// and discrete inputs that raptor-core already polls from the PLC to local
+// Modbus TCP clients (HMIs, dashboards, mbpoll) without opening another
+// session against the upstream device. Reads are answered from an
+// in-memory cache kept fresh by the main polling loop; writes are forwarded
+// upstream serially and the cache is updated on success.
+package modbusproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goburrow/modbus"
+)
+
+// Modbus function codes this proxy understands.
+const (
+	fcReadCoils            = 0x01
+	fcReadDiscreteInputs   = 0x02
+	fcReadHoldingRegisters = 0x03
+	fcReadInputRegisters   = 0x04
+	fcWriteSingleCoil      = 0x05
+	fcWriteSingleRegister  = 0x06
+)
+
+// Cache holds the most recent values read from the PLC, keyed by zero-based
+// address. The polling loop is the sole writer of reads; the proxy itself
+// only writes back the values it successfully forwards upstream.
+type Cache struct {
+	mu       sync.RWMutex
+	holding  map[uint16]uint16
+	input    map[uint16]uint16
+	coils    map[uint16]bool
+	discrete map[uint16]bool
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		holding:  make(map[uint16]uint16),
+		input:    make(map[uint16]uint16),
+		coils:    make(map[uint16]bool),
+		discrete: make(map[uint16]bool),
+	}
+}
+
+// SetHoldingBlock records a contiguous block of holding registers, e.g. the
+// result of a ReadHoldingRegisters(start, len(values)) call.
+func (c *Cache) SetHoldingBlock(start uint16, values []uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range values {
+		c.holding[start+uint16(i)] = v
+	}
+}
+
+func (c *Cache) SetInputBlock(start uint16, values []uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range values {
+		c.input[start+uint16(i)] = v
+	}
+}
+
+func (c *Cache) SetCoil(addr uint16, v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.coils[addr] = v
+}
+
+func (c *Cache) SetDiscrete(addr uint16, v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discrete[addr] = v
+}
+
+func (c *Cache) SetHolding(addr uint16, v uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.holding[addr] = v
+}
+
+// readBlock reads `qty` consecutive entries starting at `start` out of m. ok
+// is false if any address in the range has never been populated.
+func readBlock(mu *sync.RWMutex, m map[uint16]uint16, start, qty uint16) ([]uint16, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]uint16, qty)
+	for i := range out {
+		v, present := m[start+uint16(i)]
+		if !present {
+			return nil, false
+		}
+		out[i] = v
+	}
+	return out, true
+}
+
+func (c *Cache) GetHolding(start, qty uint16) ([]uint16, bool) {
+	return readBlock(&c.mu, c.holding, start, qty)
+}
+
+func (c *Cache) GetInput(start, qty uint16) ([]uint16, bool) {
+	return readBlock(&c.mu, c.input, start, qty)
+}
+
+// readBitBlock is readBlock's counterpart for the bool-valued coil/discrete
+// tables.
+func readBitBlock(mu *sync.RWMutex, m map[uint16]bool, start, qty uint16) ([]bool, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]bool, qty)
+	for i := range out {
+		v, present := m[start+uint16(i)]
+		if !present {
+			return nil, false
+		}
+		out[i] = v
+	}
+	return out, true
+}
+
+func (c *Cache) GetCoils(start, qty uint16) ([]bool, bool) {
+	return readBitBlock(&c.mu, c.coils, start, qty)
+}
+
+func (c *Cache) GetDiscreteInputs(start, qty uint16) ([]bool, bool) {
+	return readBitBlock(&c.mu, c.discrete, start, qty)
+}
+
+// ClientMetrics are the per-connection counters published on MQTT every
+// metricsPublishInterval and once more when a client disconnects.
+type ClientMetrics struct {
+	Reads  uint64 `json:"reads"`
+	Writes uint64 `json:"writes"`
+	Errors uint64 `json:"errors"`
+}
+
+// Server is a Modbus TCP server that answers reads from a Cache and forwards
+// writes upstream through a single serialized handler.
+type Server struct {
+	cache        *Cache
+	upstream     modbus.Client
+	upstreamMu   *sync.Mutex // guards every call into upstream, shared with whatever else (e.g. the poll loop) also issues requests on that same connection
+	mc           mqtt.Client
+	metricsTopic string // e.g. raptor/<site>/<device>/modbusproxy; publishMetrics appends /<remote-addr>
+}
+
+// NewServer builds a proxy server. upstreamMu must be the same mutex the
+// caller takes around any other use of upstream (e.g. a polling loop's own
+// reads) — goburrow's TCP handler is a single synchronous connection, so
+// anything less than one lock shared by every caller risks matching a
+// response to the wrong request. mc and metricsTopic may be nil/empty to
+// disable per-client metrics publishing.
+func NewServer(cache *Cache, upstream modbus.Client, upstreamMu *sync.Mutex, mc mqtt.Client, metricsTopic string) *Server {
+	return &Server{cache: cache, upstream: upstream, upstreamMu: upstreamMu, mc: mc, metricsTopic: metricsTopic}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("modbusproxy listen: %w", err)
+	}
+	defer ln.Close()
+	slog.Info("modbusproxy listening", "addr", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("modbusproxy accept failed", "error", err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// metricsPublishInterval bounds how stale a long-lived client's MQTT
+// metrics can get; handleConn also does a final publish on disconnect so
+// short-lived sessions (e.g. a one-off mbpoll query) still report.
+// It's a var, not a const, so tests can shrink it.
+var metricsPublishInterval = 30 * time.Second
+
+// handleConn speaks raw MBAP framing: a 7-byte header (transaction id,
+// protocol id, length, unit id) followed by the PDU.
+func (s *Server) handleConn(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	defer conn.Close()
+
+	metrics := &ClientMetrics{}
+	defer s.publishMetrics(remote, metrics)
+
+	stopTicker := make(chan struct{})
+	defer close(stopTicker)
+	go s.publishMetricsPeriodically(remote, metrics, stopTicker)
+
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				slog.Error("modbusproxy read header failed", "remote", remote, "error", err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if length == 0 || length > 253 {
+			slog.Error("modbusproxy bad frame length", "remote", remote, "length", length)
+			return
+		}
+		pdu := make([]byte, length-1) // length includes the unit id we already read
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			slog.Error("modbusproxy read pdu failed", "remote", remote, "error", err)
+			return
+		}
+
+		resp, err := s.handlePDU(pdu, metrics)
+		if err != nil {
+			atomic.AddUint64(&metrics.Errors, 1)
+			slog.Error("modbusproxy request failed", "remote", remote, "error", err)
+			if len(pdu) == 0 {
+				resp = []byte{0x80, 0x01} // illegal function: no function code to echo back
+			} else {
+				resp = []byte{pdu[0] | 0x80, 0x04} // exception: server device failure
+			}
+		}
+
+		out := make([]byte, 7+len(resp))
+		copy(out, header[:6])
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(resp)+1))
+		out[6] = header[6]
+		copy(out[7:], resp)
+		if _, err := conn.Write(out); err != nil {
+			slog.Error("modbusproxy write response failed", "remote", remote, "error", err)
+			return
+		}
+	}
+}
+
+func (s *Server) handlePDU(pdu []byte, metrics *ClientMetrics) ([]byte, error) {
+	if len(pdu) < 5 {
+		return nil, fmt.Errorf("short pdu")
+	}
+	fc := pdu[0]
+	start := binary.BigEndian.Uint16(pdu[1:3])
+
+	switch fc {
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		qty := binary.BigEndian.Uint16(pdu[3:5])
+		var vals []uint16
+		var ok bool
+		if fc == fcReadHoldingRegisters {
+			vals, ok = s.cache.GetHolding(start, qty)
+		} else {
+			vals, ok = s.cache.GetInput(start, qty)
+		}
+		if !ok {
+			return nil, fmt.Errorf("uncached register range %d..%d", start, start+qty)
+		}
+		atomic.AddUint64(&metrics.Reads, 1)
+		out := make([]byte, 2+2*len(vals))
+		out[0] = fc
+		out[1] = byte(2 * len(vals))
+		for i, v := range vals {
+			binary.BigEndian.PutUint16(out[2+2*i:], v)
+		}
+		return out, nil
+
+	case fcReadCoils, fcReadDiscreteInputs:
+		qty := binary.BigEndian.Uint16(pdu[3:5])
+		var vals []bool
+		var ok bool
+		if fc == fcReadCoils {
+			vals, ok = s.cache.GetCoils(start, qty)
+		} else {
+			vals, ok = s.cache.GetDiscreteInputs(start, qty)
+		}
+		if !ok {
+			return nil, fmt.Errorf("uncached coil/discrete range %d..%d", start, start+qty)
+		}
+		atomic.AddUint64(&metrics.Reads, 1)
+		nbytes := (len(vals) + 7) / 8
+		out := make([]byte, 2+nbytes)
+		out[0] = fc
+		out[1] = byte(nbytes)
+		for i, v := range vals {
+			if v {
+				out[2+i/8] |= 1 << uint(i%8)
+			}
+		}
+		return out, nil
+
+	case fcWriteSingleRegister:
+		value := binary.BigEndian.Uint16(pdu[3:5])
+		s.upstreamMu.Lock()
+		_, err := s.upstream.WriteSingleRegister(start, value)
+		s.upstreamMu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("write holding register %d: %w", start, err)
+		}
+		s.cache.SetHolding(start, value)
+		atomic.AddUint64(&metrics.Writes, 1)
+		return append([]byte{fc}, pdu[1:5]...), nil
+
+	case fcWriteSingleCoil:
+		on := binary.BigEndian.Uint16(pdu[3:5]) == 0xFF00
+		coilValue := uint16(0x0000)
+		if on {
+			coilValue = 0xFF00
+		}
+		s.upstreamMu.Lock()
+		_, err := s.upstream.WriteSingleCoil(start, coilValue)
+		s.upstreamMu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("write coil %d: %w", start, err)
+		}
+		s.cache.SetCoil(start, on)
+		atomic.AddUint64(&metrics.Writes, 1)
+		return append([]byte{fc}, pdu[1:5]...), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported function code 0x%02x", fc)
+	}
+}
+
+// publishMetricsPeriodically republishes m on a fixed interval so a
+// long-lived client (an HMI or dashboard, the case this feature targets)
+// reports live numbers instead of only the final flush on disconnect. It
+// returns once stop is closed.
+func (s *Server) publishMetricsPeriodically(remote string, m *ClientMetrics, stop <-chan struct{}) {
+	ticker := time.NewTicker(metricsPublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.publishMetrics(remote, m)
+		}
+	}
+}
+
+func (s *Server) publishMetrics(remote string, m *ClientMetrics) {
+	if s.mc == nil || s.metricsTopic == "" {
+		return
+	}
+	snapshot := ClientMetrics{
+		Reads:  atomic.LoadUint64(&m.Reads),
+		Writes: atomic.LoadUint64(&m.Writes),
+		Errors: atomic.LoadUint64(&m.Errors),
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	topic := fmt.Sprintf("%s/%s", s.metricsTopic, remote)
+	s.mc.Publish(topic, 0, false, b)
+}
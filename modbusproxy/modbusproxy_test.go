@@ -0,0 +1,116 @@
+package modbusproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandlePDUShortPDU is the regression test for the crash the review
+// flagged: a frame whose MBAP length field claims a PDU shorter than a
+// function code leaves handlePDU's caller with a zero-length pdu slice.
+func TestHandlePDUShortPDU(t *testing.T) {
+	s := &Server{cache: NewCache(), upstreamMu: &sync.Mutex{}}
+	if _, err := s.handlePDU(nil, &ClientMetrics{}); err == nil {
+		t.Fatal("handlePDU(nil) did not return an error")
+	}
+}
+
+// TestHandlePDUReadDiscreteInputs is the regression test for discrete
+// inputs being missing from the proxy's function-code switch: a profile
+// field declared as `discrete` was published over MQTT but returned
+// "unsupported function code 0x02" to any local Modbus client.
+func TestHandlePDUReadDiscreteInputs(t *testing.T) {
+	cache := NewCache()
+	cache.SetDiscrete(10, true)
+	cache.SetDiscrete(11, false)
+	s := &Server{cache: cache, upstreamMu: &sync.Mutex{}}
+
+	pdu := make([]byte, 5)
+	pdu[0] = fcReadDiscreteInputs
+	binary.BigEndian.PutUint16(pdu[1:3], 10) // start address
+	binary.BigEndian.PutUint16(pdu[3:5], 2)  // quantity
+
+	resp, err := s.handlePDU(pdu, &ClientMetrics{})
+	if err != nil {
+		t.Fatalf("handlePDU: %v", err)
+	}
+	want := []byte{fcReadDiscreteInputs, 1, 0x01} // byte count 1, bit0 set, bit1 clear
+	if string(resp) != string(want) {
+		t.Fatalf("resp = % x, want % x", resp, want)
+	}
+}
+
+// TestPublishMetricsPeriodicallyStopsOnSignal is the regression test for
+// metrics only being published once, on disconnect: a long-lived client
+// (the HMI/dashboard case this proxy targets) would otherwise report
+// all-zero metrics for its entire connection. This lets the ticker loop run
+// for several intervals (with mc nil, so the publishes themselves are not
+// observed) and checks that it exits promptly once stop is closed, so the
+// goroutine handleConn spawns per connection doesn't leak.
+func TestPublishMetricsPeriodicallyStopsOnSignal(t *testing.T) {
+	orig := metricsPublishInterval
+	metricsPublishInterval = 5 * time.Millisecond
+	defer func() { metricsPublishInterval = orig }()
+
+	s := &Server{cache: NewCache()} // mc is nil: publishMetrics is then a no-op
+	stop := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.publishMetricsPeriodically("test-client", &ClientMetrics{}, stop)
+	}()
+
+	time.Sleep(20 * time.Millisecond) // let a few ticks fire
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishMetricsPeriodically did not return after stop was closed")
+	}
+}
+
+// TestHandleConnShortFrameDoesNotPanic drives handleConn over a real
+// connection with a frame whose MBAP length field is 1, i.e. the PDU is
+// empty. Before the fix, the error branch indexed pdu[0] unconditionally and
+// panicked the goroutine for any client sending a truncated frame.
+func TestHandleConnShortFrameDoesNotPanic(t *testing.T) {
+	s := &Server{cache: NewCache(), upstreamMu: &sync.Mutex{}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConn(server)
+	}()
+
+	header := make([]byte, 7)
+	binary.BigEndian.PutUint16(header[4:6], 1) // length=1: unit id only, zero-byte PDU
+	header[6] = 1                              // unit id
+
+	if err := client.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(header); err != nil {
+		t.Fatalf("write short frame: %v", err)
+	}
+
+	resp := make([]byte, 9)
+	n, err := client.Read(resp)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	resp = resp[:n]
+	if len(resp) != 9 || resp[7] != 0x80 || resp[8] != 0x01 {
+		t.Fatalf("response = % x, want illegal-function exception (.. 80 01)", resp)
+	}
+
+	client.Close()
+	<-done
+}
@@ -0,0 +1,516 @@
+// Package agent runs the raptor-core device loop: it polls the PLC over
+// Modbus according to a device profile, publishes state to MQTT, and accepts
+// commands back from MQTT to write through to the PLC. main.go is a thin
+// wrapper around Run.
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/goburrow/modbus"
+
+	"raptor-core/modbusproxy"
+	"raptor-core/raptor/metrics"
+	"raptor-core/raptor/profile"
+	"raptor-core/raptor/spool"
+)
+
+func env(k, def string) string { if v := os.Getenv(k); v != "" { return v }; return def }
+
+func envInt(k string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(k))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(k))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// CmdResult is published on raptor/<site>/<device>/cmd/<name>/result after a
+// command is applied (or rejected).
+type CmdResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// cmdPayload is the expected shape of an incoming command message, e.g.
+// {"value": 1800} or {"value": true}.
+type cmdPayload struct {
+	Value json.RawMessage `json:"value"`
+}
+
+func Run() error {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	site := env("RAPTOR_SITE", "shop")
+	device := env("RAPTOR_DEVICE", "revpi-135593")
+	mbAddr := env("MODBUS_ADDR", "10.0.106.100:502")
+	mqttURL := env("MQTT_URL", "tcp://10.0.106.22:1883")
+	mqUser := os.Getenv("MQTT_USER")
+	mqPass := os.Getenv("MQTT_PASS")
+	profilePath := env("RAPTOR_PROFILE", "profiles/wheels-v2.yaml")
+
+	prof, err := profile.Load(profilePath)
+	if err != nil {
+		return fmt.Errorf("load device profile: %w", err)
+	}
+
+	stateTopic := fmt.Sprintf("raptor/%s/%s/state", site, device)
+	statusTopic := fmt.Sprintf("raptor/%s/%s/status", site, device)
+	discoveryTopic := fmt.Sprintf("raptor/%s/%s/discovery", site, device)
+	cmdTopicFilter := fmt.Sprintf("raptor/%s/%s/cmd/+", site, device)
+
+	// client is read from Run's own goroutine only (poll loop, proxy setup).
+	// clientPtr is the cross-goroutine handle: handleCommand runs on paho's
+	// callback goroutine and can fire before the assignment below, so it
+	// reads through an atomic pointer instead of racing client directly.
+	var client modbus.Client
+	var clientPtr atomic.Pointer[modbus.Client]
+	upstreamMu := &sync.Mutex{} // guards every call into client; shared with the poll loop below and modbusproxy.Server
+
+	// MQTT
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttURL).
+		SetClientID("raptor-core-"+device).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetWill(statusTopic, "offline", 1, true)
+	if mqUser != "" {
+		opts.SetUsername(mqUser)
+		opts.SetPassword(mqPass)
+	}
+	opts.SetOnConnectHandler(func(mc mqtt.Client) {
+		mc.Publish(statusTopic, 1, true, "online")
+		if b, err := json.Marshal(discoveryPayload(site, device, prof)); err == nil {
+			mc.Publish(discoveryTopic, 1, true, b)
+		}
+		if tok := mc.Subscribe(cmdTopicFilter, 1, func(mc mqtt.Client, msg mqtt.Message) {
+			handleCommand(mc, &clientPtr, upstreamMu, prof, site, device, msg)
+		}); tok.WaitTimeout(5*time.Second) && tok.Error() != nil {
+			slog.Error("mqtt subscribe failed", "topic", cmdTopicFilter, "error", tok.Error())
+		}
+	})
+	mc := mqtt.NewClient(opts)
+	if tok := mc.Connect(); !tok.WaitTimeout(10*time.Second) || tok.Error() != nil {
+		return fmt.Errorf("mqtt connect: %w", tok.Error())
+	}
+	defer mc.Disconnect(250)
+
+	// Modbus
+	handler := modbus.NewTCPClientHandler(mbAddr)
+	handler.Timeout = 5 * time.Second
+	handler.SlaveId = 1
+	if err := handler.Connect(); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer handler.Close()
+	client = modbus.NewClient(handler)
+	clientPtr.Store(&client)
+
+	// Proxy: local clients (HMIs, dashboards, mbpoll) read from a cache kept
+	// fresh by the poll loop below instead of opening their own session
+	// against the PLC.
+	// upstreamMu guards every call into client, from both the proxy's writes
+	// and the poll loop's own reads below — goburrow's TCP handler is a
+	// single synchronous connection, so anything less than one shared lock
+	// risks matching a response to the wrong request.
+	regCache := modbusproxy.NewCache()
+	proxyAddr := env("MODBUS_PROXY_ADDR", ":1502")
+	proxy := modbusproxy.NewServer(regCache, client, upstreamMu, mc, fmt.Sprintf("raptor/%s/%s/modbusproxy", site, device))
+	go func() {
+		if err := proxy.ListenAndServe(proxyAddr); err != nil {
+			slog.Error("modbusproxy stopped", "error", err)
+		}
+	}()
+
+	// Metrics: Modbus/MQTT counters, field gauges, scraped by a fleet monitor.
+	m := metrics.New()
+	metricsAddr := env("METRICS_ADDR", ":9100")
+	go func() {
+		if err := m.ListenAndServe(metricsAddr); err != nil {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+
+	holdingBlocks := prof.Blocks(profile.HoldingRegister)
+	inputBlocks := prof.Blocks(profile.InputRegister)
+	coilBlocks := prof.Blocks(profile.Coil)
+	discreteBlocks := prof.Blocks(profile.DiscreteInput)
+
+	// Spool: every snapshot is enqueued here first and published by the
+	// drain loop below, so a dropped MQTT connection doesn't lose telemetry
+	// until RAPTOR_SPOOL_MAX entries are buffered; past that, the oldest
+	// entries are evicted.
+	spoolPath := env("RAPTOR_SPOOL_PATH", "raptor.spool.db")
+	spoolMax := envInt("RAPTOR_SPOOL_MAX", 10000)
+	sp, err := spool.Open(spoolPath, spoolMax)
+	if err != nil {
+		return fmt.Errorf("open spool: %w", err)
+	}
+	defer sp.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go sp.Drain(stop, func(payload []byte, replayed bool) error {
+		if replayed {
+			var withFlag map[string]any
+			if err := json.Unmarshal(payload, &withFlag); err == nil {
+				withFlag["replayed"] = true
+				if b, err := json.Marshal(withFlag); err == nil {
+					payload = b
+				}
+			}
+		}
+		tok := mc.Publish(stateTopic, 1, false, payload)
+		var err error
+		if !tok.WaitTimeout(10 * time.Second) {
+			err = fmt.Errorf("publish timed out")
+		} else {
+			err = tok.Error()
+		}
+		m.ObservePublish(err)
+		return err
+	}, 10*time.Second)
+
+	pollInterval := 2 * time.Second
+	heartbeatInterval := envDuration("RAPTOR_HEARTBEAT", 30*time.Second)
+	var seq uint64
+
+	lastPublished := make(map[string]any, len(prof.Fields))
+	var lastPublishTime time.Time
+	startup := true
+
+	for {
+		fields := make(map[string]any, len(prof.Fields))
+		ok := true
+
+		ok = pollRegisterBlocks(regCache, m, holdingBlocks, locked(upstreamMu, client.ReadHoldingRegisters), fields) && ok
+		ok = pollRegisterBlocks(regCache, m, inputBlocks, locked(upstreamMu, client.ReadInputRegisters), fields) && ok
+		ok = pollBitBlocks(regCache, m, coilBlocks, locked(upstreamMu, client.ReadCoils), fields) && ok
+		ok = pollBitBlocks(regCache, m, discreteBlocks, locked(upstreamMu, client.ReadDiscreteInputs), fields) && ok
+		if !ok {
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		changed := publishChangedFields(mc, site, device, prof, lastPublished, fields)
+
+		reason := ""
+		switch {
+		case startup:
+			reason = "startup"
+		case len(changed) > 0:
+			reason = "change"
+		case time.Since(lastPublishTime) >= heartbeatInterval:
+			reason = "heartbeat"
+		}
+		if reason == "" {
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		seqN := atomic.AddUint64(&seq, 1)
+		fields["seq"] = seqN
+		fields["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+		fields["reason"] = reason
+		m.SetSeq(seqN)
+
+		b, _ := json.Marshal(fields)
+		if err := sp.Enqueue(b); err != nil {
+			slog.Error("spool enqueue failed", "error", err)
+		}
+
+		slog.Info("polled", "seq", seqN, "reason", reason, "changed", changed)
+
+		lastPublishTime = time.Now()
+		startup = false
+		time.Sleep(pollInterval)
+	}
+}
+
+// fieldTopic is where a single field's retained current value is published,
+// separate from the full state snapshot, so late-joining subscribers see it
+// immediately without waiting for the next change or heartbeat.
+func fieldTopic(site, device, name string) string {
+	return fmt.Sprintf("raptor/%s/%s/field/%s", site, device, name)
+}
+
+// publishChangedFields compares fields against the last published baseline
+// per-field deadband, publishes a retained update for each field that
+// crossed its deadband, and returns their keys. lastPublished is updated in
+// place so the next call compares against the newly published values.
+func publishChangedFields(mc mqtt.Client, site, device string, prof *profile.Profile, lastPublished, fields map[string]any) []string {
+	var changed []string
+	for _, f := range prof.Fields {
+		key := f.Key()
+		cur, ok := fields[key]
+		if !ok {
+			continue
+		}
+		prev, hadPrev := lastPublished[key]
+		if hadPrev && coveredByDeadband(f, prev, cur) {
+			continue
+		}
+		lastPublished[key] = cur
+		changed = append(changed, key)
+		if b, err := json.Marshal(cur); err == nil {
+			mc.Publish(fieldTopic(site, device, key), 1, true, b)
+		}
+	}
+	return changed
+}
+
+// coveredByDeadband reports whether cur is still within prev's deadband,
+// i.e. NOT a change worth publishing.
+func coveredByDeadband(f profile.Field, prev, cur any) bool {
+	switch c := cur.(type) {
+	case bool:
+		p, ok := prev.(bool)
+		return ok && p == c
+	case float64:
+		p, ok := prev.(float64)
+		if !ok {
+			return false
+		}
+		deadband := 0.0
+		if f.Deadband != nil {
+			deadband = *f.Deadband
+		}
+		diff := c - p
+		if diff < 0 {
+			diff = -diff
+		}
+		return diff <= deadband
+	default:
+		return false
+	}
+}
+
+// locked wraps a Modbus read so it takes mu for the duration of the call,
+// the same mutex the proxy takes around its writes against the same
+// upstream connection.
+func locked(mu *sync.Mutex, read func(address, quantity uint16) ([]byte, error)) func(address, quantity uint16) ([]byte, error) {
+	return func(address, quantity uint16) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return read(address, quantity)
+	}
+}
+
+// blockLabel identifies a block in logs and metrics.
+func blockLabel(block profile.Block) string {
+	return fmt.Sprintf("%s:%d", block.Function, block.Start)
+}
+
+// pollRegisterBlocks reads each holding/input register block, decodes its
+// fields into `fields`, and mirrors the raw words into the proxy cache.
+func pollRegisterBlocks(cache *modbusproxy.Cache, m *metrics.Metrics, blocks []profile.Block, read func(address, quantity uint16) ([]byte, error), fields map[string]any) bool {
+	ok := true
+	for _, block := range blocks {
+		label := blockLabel(block)
+		start := time.Now()
+		raw, err := read(block.Start, block.Count)
+		if err == nil && len(raw) < int(block.Count)*2 {
+			err = fmt.Errorf("unexpected length %d", len(raw))
+		}
+		m.ObserveRead(label, time.Since(start), err)
+		if err != nil {
+			slog.Error("block read failed", "block", label, "error", err)
+			ok = false
+			continue
+		}
+		words := make([]uint16, block.Count)
+		for i := range words {
+			words[i] = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+		}
+		if block.Function == profile.HoldingRegister {
+			cache.SetHoldingBlock(block.Start, words)
+		} else {
+			cache.SetInputBlock(block.Start, words)
+		}
+
+		offset := uint16(0)
+		for _, f := range block.Fields {
+			v, err := profile.Decode(f, words, offset)
+			if err != nil {
+				slog.Error("field decode failed", "field", f.Name, "error", err)
+			} else {
+				fields[f.Key()] = v
+				m.SetField(f.Key(), v)
+			}
+			offset += f.Words()
+		}
+	}
+	return ok
+}
+
+// pollBitBlocks reads each coil/discrete block and decodes its fields into
+// `fields`, also mirroring their bits into the proxy cache so modbusproxy
+// clients see the same data.
+func pollBitBlocks(cache *modbusproxy.Cache, m *metrics.Metrics, blocks []profile.Block, read func(address, quantity uint16) ([]byte, error), fields map[string]any) bool {
+	ok := true
+	for _, block := range blocks {
+		label := blockLabel(block)
+		start := time.Now()
+		raw, err := read(block.Start, block.Count)
+		if err == nil && len(raw) < 1 {
+			err = fmt.Errorf("unexpected length %d", len(raw))
+		}
+		m.ObserveRead(label, time.Since(start), err)
+		if err != nil {
+			slog.Error("block read failed", "block", label, "error", err)
+			ok = false
+			continue
+		}
+		for i, f := range block.Fields {
+			bit := (raw[i/8] & (1 << uint(i%8))) != 0
+			fields[f.Key()] = bit
+			bitFloat := float64(0)
+			if bit {
+				bitFloat = 1
+			}
+			m.SetField(f.Key(), bitFloat)
+			switch block.Function {
+			case profile.Coil:
+				cache.SetCoil(block.Start+uint16(i), bit)
+			case profile.DiscreteInput:
+				cache.SetDiscrete(block.Start+uint16(i), bit)
+			}
+		}
+	}
+	return ok
+}
+
+// handleCommand translates an incoming raptor/<site>/<device>/cmd/<name>
+// message into a PLC write and publishes the outcome to
+// raptor/<site>/<device>/cmd/<name>/result. clientPtr is loaded atomically
+// since this runs on paho's callback goroutine, which races Run's plain
+// assignment of client during startup.
+func handleCommand(mc mqtt.Client, clientPtr *atomic.Pointer[modbus.Client], upstreamMu *sync.Mutex, prof *profile.Profile, site, device string, msg mqtt.Message) {
+	name := msg.Topic()[len(fmt.Sprintf("raptor/%s/%s/cmd/", site, device)):]
+	resultTopic := fmt.Sprintf("raptor/%s/%s/cmd/%s/result", site, device, name)
+
+	cp := clientPtr.Load()
+	if cp == nil {
+		// The command subscription is armed as soon as MQTT connects, which
+		// can race the (up to several seconds) Modbus handshake on startup.
+		publishResult(mc, resultTopic, CmdResult{OK: false, Error: "not ready: PLC connection not yet established"})
+		return
+	}
+	client := *cp
+
+	f, ok := prof.FieldByName(name)
+	if !ok || !f.Writable {
+		publishResult(mc, resultTopic, CmdResult{OK: false, Error: fmt.Sprintf("unknown or read-only command %q", name)})
+		return
+	}
+
+	var payload cmdPayload
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		publishResult(mc, resultTopic, CmdResult{OK: false, Error: fmt.Sprintf("invalid payload: %v", err)})
+		return
+	}
+
+	value, err := applyCommand(client, upstreamMu, f, payload.Value)
+	if err != nil {
+		publishResult(mc, resultTopic, CmdResult{OK: false, Error: err.Error()})
+		return
+	}
+	publishResult(mc, resultTopic, CmdResult{OK: true, Value: value})
+}
+
+// applyCommand issues the write(s) for a single command under upstreamMu —
+// the same mutex the poll loop and modbusproxy take around every other call
+// into client, since goburrow's TCP handler is a single synchronous
+// connection shared by all three callers.
+func applyCommand(client modbus.Client, upstreamMu *sync.Mutex, f profile.Field, raw json.RawMessage) (any, error) {
+	switch f.Function {
+	case profile.Coil:
+		var on bool
+		if err := json.Unmarshal(raw, &on); err != nil {
+			return nil, fmt.Errorf("%s: expected bool: %w", f.Name, err)
+		}
+		coilValue := uint16(0x0000)
+		if on {
+			coilValue = 0xFF00
+		}
+		upstreamMu.Lock()
+		_, err := client.WriteSingleCoil(f.ZeroBased(), coilValue)
+		upstreamMu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("write %s: %w", f.Name, err)
+		}
+		return on, nil
+
+	case profile.HoldingRegister:
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s: expected number: %w", f.Name, err)
+		}
+		if f.Min != nil && value < *f.Min || f.Max != nil && value > *f.Max {
+			return nil, fmt.Errorf("%s: %v out of range", f.Name, value)
+		}
+		words, err := profile.Encode(f, value)
+		if err != nil {
+			return nil, err
+		}
+		addr := f.ZeroBased()
+		upstreamMu.Lock()
+		defer upstreamMu.Unlock()
+		for i, w := range words {
+			if _, err := client.WriteSingleRegister(addr+uint16(i), w); err != nil {
+				return nil, fmt.Errorf("write %s: %w", f.Name, err)
+			}
+		}
+		return value, nil
+
+	default:
+		return nil, fmt.Errorf("%s: function %q is not writable", f.Name, f.Function)
+	}
+}
+
+func publishResult(mc mqtt.Client, topic string, res CmdResult) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	mc.Publish(topic, 1, false, b)
+}
+
+// discoveryPayload describes the device's published state fields and
+// accepted commands so downstream tools can auto-configure without a
+// separate config file.
+func discoveryPayload(site, device string, prof *profile.Profile) map[string]any {
+	var commands []string
+	var fields []string
+	for _, f := range prof.Fields {
+		fields = append(fields, f.Key())
+		if f.Writable {
+			commands = append(commands, f.Name)
+		}
+	}
+	return map[string]any{
+		"site":        site,
+		"device":      device,
+		"state_topic": fmt.Sprintf("raptor/%s/%s/state", site, device),
+		"fields":      fields,
+		"commands":    commands,
+	}
+}
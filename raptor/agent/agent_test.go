@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"raptor-core/raptor/profile"
+)
+
+func TestCoveredByDeadband(t *testing.T) {
+	f := profile.Field{Deadband: ptr(2.0)}
+	cases := []struct {
+		name      string
+		prev, cur any
+		wantCov   bool
+	}{
+		{"within deadband", 1000.0, 1001.0, true},
+		{"exceeds deadband", 1000.0, 1100.0, false},
+		{"exactly at deadband", 1000.0, 1002.0, true},
+		{"bool unchanged", true, true, true},
+		{"bool changed", true, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := coveredByDeadband(f, c.prev, c.cur); got != c.wantCov {
+				t.Errorf("coveredByDeadband(%v, %v) = %v, want %v", c.prev, c.cur, got, c.wantCov)
+			}
+		})
+	}
+}
+
+// TestPublishChangedFieldsRespectsDeadband is the regression test for the
+// inverted guard in publishChangedFields: a move that stays within the
+// field's deadband must NOT be reported as changed, and a move that crosses
+// it must be.
+func TestPublishChangedFieldsRespectsDeadband(t *testing.T) {
+	prof := &profile.Profile{Fields: []profile.Field{
+		{Name: "actual_rpm", Deadband: ptr(2.0)},
+	}}
+	lastPublished := map[string]any{"actual_rpm": 1000.0}
+
+	// mc is never connected; publishChangedFields only needs it to not
+	// panic, since Publish on a disconnected client just returns an error
+	// token rather than touching the network.
+	mc := mqtt.NewClient(mqtt.NewClientOptions())
+
+	changed := publishChangedFields(mc, "shop", "dev1", prof, lastPublished, map[string]any{"actual_rpm": 1001.0})
+	if len(changed) != 0 {
+		t.Errorf("value within deadband (1000->1001) reported changed: %v", changed)
+	}
+
+	changed = publishChangedFields(mc, "shop", "dev1", prof, lastPublished, map[string]any{"actual_rpm": 1100.0})
+	if len(changed) != 1 || changed[0] != "actual_rpm" {
+		t.Errorf("value past deadband (1000->1100) not reported changed: %v", changed)
+	}
+}
+
+func ptr(f float64) *float64 { return &f }
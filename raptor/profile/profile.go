@@ -0,0 +1,212 @@
+// Package profile loads a device's register map from a YAML or JSON file so
+// raptor-core can be retargeted to a new machine without recompiling. A
+// profile declares, per field, which Modbus table it lives in, its address,
+// data type, scale, and the MQTT key it publishes under.
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Function identifies which Modbus table a field lives in.
+type Function string
+
+const (
+	HoldingRegister Function = "holding"
+	InputRegister   Function = "input"
+	Coil            Function = "coil"
+	DiscreteInput   Function = "discrete"
+)
+
+// DataType identifies how a register field's raw words decode to a value.
+// Coil and DiscreteInput fields ignore DataType; they're always single bits.
+type DataType string
+
+const (
+	TypeU16     DataType = "u16"
+	TypeI16     DataType = "i16"
+	TypeU32BE   DataType = "u32be" // big-endian word order (most PLCs)
+	TypeU32LE   DataType = "u32le" // little-endian word order
+	TypeFloat32 DataType = "float32"
+	TypeBool    DataType = "bool"
+)
+
+// Field is one entry in a device profile.
+type Field struct {
+	Name     string   `yaml:"name" json:"name"`
+	Function Function `yaml:"function" json:"function"`
+	Address  uint16   `yaml:"address" json:"address"` // protocol-relative offset within Function's table, NOT 5-digit Modicon notation (40001-style); see OneBased
+	OneBased bool     `yaml:"one_based" json:"one_based"`
+	DataType DataType `yaml:"data_type" json:"data_type"`
+	Scale    float64  `yaml:"scale" json:"scale"`
+	Unit     string   `yaml:"unit" json:"unit"`
+	Topic    string   `yaml:"topic" json:"topic"` // MQTT sub-topic / JSON key published under; defaults to Name
+	Writable bool     `yaml:"writable" json:"writable"`
+	Min      *float64 `yaml:"min" json:"min"` // range check for writable numeric registers: out-of-range commands are rejected, not clamped; nil disables the check
+	Max      *float64 `yaml:"max" json:"max"`
+	Deadband *float64 `yaml:"deadband" json:"deadband"` // COV threshold; nil means "any change publishes"
+}
+
+// Key is the JSON/MQTT key this field publishes under.
+func (f Field) Key() string {
+	if f.Topic != "" {
+		return f.Topic
+	}
+	return f.Name
+}
+
+// ZeroBased normalizes Address to the zero-based form goburrow/modbus expects.
+func (f Field) ZeroBased() uint16 {
+	if f.OneBased && f.Address > 0 {
+		return f.Address - 1
+	}
+	return f.Address
+}
+
+// Words reports how many 16-bit registers this field occupies. Only
+// meaningful for holding/input registers; coils and discretes are one bit.
+func (f Field) Words() uint16 {
+	switch f.DataType {
+	case TypeU32BE, TypeU32LE, TypeFloat32:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Profile is a device's full register map.
+type Profile struct {
+	Fields []Field `yaml:"fields" json:"fields"`
+}
+
+// Load reads a profile from path, dispatching on its extension.
+func Load(path string) (*Profile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profile %s: %w", path, err)
+	}
+	var p Profile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("parse profile %s: %w", path, err)
+		}
+	case ".json":
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("parse profile %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("profile %s: unsupported extension %q (want .yaml, .yml or .json)", path, ext)
+	}
+	return &p, nil
+}
+
+// FieldByName returns the field with the given name, if present.
+func (p *Profile) FieldByName(name string) (Field, bool) {
+	for _, f := range p.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// Block is a contiguous run of addresses to read in a single Modbus request.
+type Block struct {
+	Function Function
+	Start    uint16 // zero-based
+	Count    uint16 // registers (words) for holding/input, bits for coil/discrete
+	Fields   []Field
+}
+
+// Blocks groups the profile's fields of the given function into the fewest
+// contiguous block reads. A gap between two fields' addresses starts a new
+// block, so unlike the original hard-coded 40002..40005 read, 40004 is not
+// read and that range becomes two blocks.
+func (p *Profile) Blocks(fn Function) []Block {
+	var fields []Field
+	for _, f := range p.Fields {
+		if f.Function == fn {
+			fields = append(fields, f)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].ZeroBased() < fields[j].ZeroBased() })
+
+	var blocks []Block
+	for _, f := range fields {
+		addr := f.ZeroBased()
+		width := f.Words()
+		if fn == Coil || fn == DiscreteInput {
+			width = 1
+		}
+		if len(blocks) > 0 {
+			last := &blocks[len(blocks)-1]
+			if addr == last.Start+last.Count {
+				last.Count += width
+				last.Fields = append(last.Fields, f)
+				continue
+			}
+		}
+		blocks = append(blocks, Block{Function: fn, Start: addr, Count: width, Fields: []Field{f}})
+	}
+	return blocks
+}
+
+// Decode extracts a register field's scaled value from raw, the block's full
+// word slice, starting at offset words into that slice.
+func Decode(f Field, raw []uint16, offset uint16) (float64, error) {
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	switch f.DataType {
+	case TypeU16, "":
+		return float64(raw[offset]) * scale, nil
+	case TypeI16:
+		return float64(int16(raw[offset])) * scale, nil
+	case TypeU32BE:
+		return float64(uint32(raw[offset])<<16|uint32(raw[offset+1])) * scale, nil
+	case TypeU32LE:
+		return float64(uint32(raw[offset+1])<<16|uint32(raw[offset])) * scale, nil
+	case TypeFloat32:
+		bits := uint32(raw[offset])<<16 | uint32(raw[offset+1])
+		return float64(math.Float32frombits(bits)) * scale, nil
+	default:
+		return 0, fmt.Errorf("field %s: unsupported data type %q", f.Name, f.DataType)
+	}
+}
+
+// Encode converts a scaled value back into the raw register word(s) to write
+// for a writable field.
+func Encode(f Field, value float64) ([]uint16, error) {
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	raw := value / scale
+	switch f.DataType {
+	case TypeU16, "":
+		return []uint16{uint16(raw)}, nil
+	case TypeI16:
+		return []uint16{uint16(int16(raw))}, nil
+	case TypeU32BE:
+		v := uint32(raw)
+		return []uint16{uint16(v >> 16), uint16(v)}, nil
+	case TypeU32LE:
+		v := uint32(raw)
+		return []uint16{uint16(v), uint16(v >> 16)}, nil
+	case TypeFloat32:
+		bits := math.Float32bits(float32(raw))
+		return []uint16{uint16(bits >> 16), uint16(bits)}, nil
+	default:
+		return nil, fmt.Errorf("field %s: unsupported data type %q", f.Name, f.DataType)
+	}
+}
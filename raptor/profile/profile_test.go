@@ -0,0 +1,67 @@
+package profile
+
+import "testing"
+
+func TestFieldZeroBased(t *testing.T) {
+	cases := []struct {
+		name string
+		f    Field
+		want uint16
+	}{
+		{"one-based protocol offset", Field{Address: 2, OneBased: true}, 1},
+		{"zero-based address passed through", Field{Address: 16032, OneBased: false}, 16032},
+		{"one-based address zero is left alone", Field{Address: 0, OneBased: true}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.f.ZeroBased(); got != c.want {
+				t.Errorf("ZeroBased() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		f    Field
+		raw  []uint16
+		want float64
+	}{
+		{"u16", Field{DataType: TypeU16}, []uint16{1800}, 1800},
+		{"u16 scaled", Field{DataType: TypeU16, Scale: 0.1}, []uint16{1800}, 180},
+		{"i16 negative", Field{DataType: TypeI16}, []uint16{0xFFFF}, -1},
+		{"u32be", Field{DataType: TypeU32BE}, []uint16{0x0001, 0x0000}, 65536},
+		{"float32", Field{DataType: TypeFloat32}, []uint16{0x4120, 0x0000}, 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Decode(c.f, c.raw, 0)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got != c.want {
+				t.Errorf("Decode() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBlocksGroupsContiguousAddresses(t *testing.T) {
+	p := &Profile{Fields: []Field{
+		{Name: "target_rpm", Function: HoldingRegister, Address: 2, OneBased: true, DataType: TypeU16},
+		{Name: "actual_rpm", Function: HoldingRegister, Address: 3, OneBased: true, DataType: TypeU16},
+		{Name: "voltage", Function: HoldingRegister, Address: 5, OneBased: true, DataType: TypeU16},
+	}}
+
+	blocks := p.Blocks(HoldingRegister)
+	if len(blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2 (a gap at offset 3 should split the run)", len(blocks))
+	}
+	if blocks[0].Start != 1 || blocks[0].Count != 2 {
+		t.Errorf("block 0 = start %d count %d, want start 1 count 2", blocks[0].Start, blocks[0].Count)
+	}
+	if blocks[1].Start != 4 || blocks[1].Count != 1 {
+		t.Errorf("block 1 = start %d count %d, want start 4 count 1", blocks[1].Start, blocks[1].Count)
+	}
+}
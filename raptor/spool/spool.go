@@ -0,0 +1,197 @@
+// Package spool is a durable, ordered store-and-forward queue backed by
+// bbolt so that snapshots produced while the MQTT connection is dropped
+// aren't lost. Every payload is enqueued before publish is attempted; a
+// drain loop retries the oldest entry until it's acknowledged, then deletes
+// it and moves on.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const bucketName = "queue"
+
+type Spool struct {
+	db      *bolt.DB
+	maxSize int // 0 = unbounded
+
+	countMu sync.Mutex
+	count   int // mirrors the bucket's key count; avoids an O(n) Stats() scan per Enqueue
+}
+
+// record is the envelope stored for each entry; EnqueuedAt lets the drain
+// loop decide whether an entry is being delivered live or replayed after a
+// backlog.
+type record struct {
+	Payload    []byte    `json:"payload"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// Open opens (creating if necessary) a spool file at path. maxSize caps the
+// number of buffered entries; once full, Enqueue evicts the oldest entry
+// first (FIFO). maxSize <= 0 means unbounded.
+func Open(path string, maxSize int) (*Spool, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open spool %s: %w", path, err)
+	}
+	var n int
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		n = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init spool bucket: %w", err)
+	}
+	return &Spool{db: db, maxSize: maxSize, count: n}, nil
+}
+
+func (s *Spool) Close() error { return s.db.Close() }
+
+// Enqueue appends payload to the tail of the spool.
+func (s *Spool) Enqueue(payload []byte) error {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if s.maxSize > 0 {
+			for s.count >= s.maxSize {
+				k, _ := b.Cursor().First()
+				if k == nil {
+					break
+				}
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				s.count--
+			}
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(record{Payload: payload, EnqueuedAt: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		if err := b.Put(seqKey(seq), val); err != nil {
+			return err
+		}
+		s.count++
+		return nil
+	})
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// oldest returns the oldest undelivered entry, or ok=false if the spool is
+// empty.
+func (s *Spool) oldest() (seq uint64, payload []byte, enqueuedAt time.Time, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket([]byte(bucketName)).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		var rec record
+		if jerr := json.Unmarshal(v, &rec); jerr != nil {
+			return jerr
+		}
+		seq, payload, enqueuedAt, ok = binary.BigEndian.Uint64(k), rec.Payload, rec.EnqueuedAt, true
+		return nil
+	})
+	return
+}
+
+func (s *Spool) delete(seq uint64) error {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b.Get(seqKey(seq)) == nil {
+			return nil // already evicted by Enqueue while it was being published
+		}
+		if err := b.Delete(seqKey(seq)); err != nil {
+			return err
+		}
+		s.count--
+		return nil
+	})
+}
+
+// Len reports how many entries are currently buffered.
+func (s *Spool) Len() (int, error) {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	return s.count, nil
+}
+
+// Publish performs the actual delivery of one entry. replayed is true when
+// the entry sat in the spool longer than Drain's resendAfter threshold,
+// i.e. it's a backlog replay rather than a live publish.
+type Publish func(payload []byte, replayed bool) error
+
+// Drain publishes the spool's entries in order, oldest first, deleting each
+// one only after publish returns nil (i.e. after PUBACK). On publish
+// failure it backs off and retries the same entry rather than advancing, so
+// ordering is preserved across broker outages. It returns when stop is
+// closed. This single loop also performs the startup flush: on the first
+// pass it simply drains whatever entries a previous run left behind before
+// catching up to live traffic.
+func (s *Spool) Drain(stop <-chan struct{}, publish Publish, resendAfter time.Duration) {
+	const idleBackoff = 500 * time.Millisecond
+	const errBackoff = 2 * time.Second
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		seq, payload, enqueuedAt, ok, err := s.oldest()
+		if err != nil {
+			slog.Error("spool read oldest entry failed", "error", err)
+			sleep(stop, errBackoff)
+			continue
+		}
+		if !ok {
+			sleep(stop, idleBackoff)
+			continue
+		}
+
+		replayed := time.Since(enqueuedAt) > resendAfter
+		if err := publish(payload, replayed); err != nil {
+			slog.Error("spool publish failed, retrying", "seq", seq, "error", err)
+			sleep(stop, errBackoff)
+			continue
+		}
+		if err := s.delete(seq); err != nil {
+			slog.Error("spool delete entry failed", "seq", seq, "error", err)
+		}
+	}
+}
+
+func sleep(stop <-chan struct{}, d time.Duration) {
+	select {
+	case <-stop:
+	case <-time.After(d):
+	}
+}
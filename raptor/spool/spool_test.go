@@ -0,0 +1,118 @@
+package spool
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T, maxSize int) *Spool {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "spool.db"), maxSize)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestEnqueueEvictsOldestAtCapacity(t *testing.T) {
+	s := openTestSpool(t, 3)
+
+	for _, payload := range [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")} {
+		if err := s.Enqueue(payload); err != nil {
+			t.Fatalf("Enqueue(%s): %v", payload, err)
+		}
+	}
+
+	n, err := s.Len()
+	if err != nil {
+		t.Fatalf("Len: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Len() = %d, want 3", n)
+	}
+
+	var got [][]byte
+	for i := 0; i < 3; i++ {
+		seq, payload, _, ok, err := s.oldest()
+		if err != nil {
+			t.Fatalf("oldest: %v", err)
+		}
+		if !ok {
+			t.Fatalf("oldest: spool unexpectedly empty at i=%d", i)
+		}
+		got = append(got, payload)
+		if err := s.delete(seq); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	want := []string{"b", "c", "d"}
+	for i, w := range want {
+		if string(got[i]) != w {
+			t.Errorf("entry %d = %q, want %q (oldest entry %q was not evicted)", i, got[i], w, "a")
+		}
+	}
+}
+
+func TestDrainPublishesInOrderAndDeletesOnlyAfterAck(t *testing.T) {
+	s := openTestSpool(t, 0)
+
+	for _, payload := range [][]byte{[]byte("1"), []byte("2"), []byte("3")} {
+		if err := s.Enqueue(payload); err != nil {
+			t.Fatalf("Enqueue(%s): %v", payload, err)
+		}
+	}
+
+	var published []string
+	failFirstAttempt := true
+	publish := func(payload []byte, replayed bool) error {
+		if failFirstAttempt {
+			failFirstAttempt = false
+			return errFake
+		}
+		published = append(published, string(payload))
+		return nil
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Drain(stop, publish, time.Hour)
+	}()
+
+	deadline := time.After(4 * time.Second)
+	for {
+		n, err := s.Len()
+		if err != nil {
+			t.Fatalf("Len: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("drain did not empty the spool in time, %d entries left", n)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	close(stop)
+	<-done
+
+	want := []string{"1", "2", "3"}
+	if len(published) != len(want) {
+		t.Fatalf("published = %v, want %v", published, want)
+	}
+	for i, w := range want {
+		if published[i] != w {
+			t.Errorf("published[%d] = %q, want %q (out of order)", i, published[i], w)
+		}
+	}
+}
+
+type fakeErr string
+
+func (e fakeErr) Error() string { return string(e) }
+
+const errFake = fakeErr("publish failed")